@@ -0,0 +1,231 @@
+//  Copyright 2017 Walter Schulze
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package derive
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// NewBundledImport copies the given top-level declarations of path into
+// the generated file instead of importing it, renaming everything with
+// name + "_" to avoid collisions. The returned Import evaluates to the
+// chosen prefix, e.g. p.P("%sHelper(x)", bundled()).
+//
+// A repeat call with the same name and path is a no-op past the first; it
+// must request the same symbols every time, or it panics.
+func (p *printer) NewBundledImport(name, path string, symbols ...string) Import {
+	prefix := name + "_"
+	key := prefix + "\x00" + path
+	requested := strings.Join(symbols, ",")
+	return func() string {
+		if p.bundledKeys == nil {
+			p.bundledKeys = make(map[string]string)
+		}
+		if got, ok := p.bundledKeys[key]; ok {
+			if got != requested {
+				panic(fmt.Sprintf("goderive: %q already bundled from %q with symbols %q, now requested with %q", prefix, path, got, requested))
+			}
+			return prefix
+		}
+		p.bundledKeys[key] = requested
+		if err := p.bundle(prefix, path, symbols); err != nil {
+			panic("goderive: bundling " + path + ": " + err.Error())
+		}
+		return prefix
+	}
+}
+
+// bundle loads path with go/packages and hands it to bundlePackage,
+// following the technique used by golang.org/x/tools/cmd/bundle.
+func (p *printer) bundle(prefix, path string, symbols []string) error {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo,
+	}
+	pkgs, err := packages.Load(cfg, path)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) != 1 {
+		return fmt.Errorf("bundle: expected exactly one package for %q, got %d", path, len(pkgs))
+	}
+	pkg := pkgs[0]
+	if len(pkg.Errors) > 0 {
+		return pkg.Errors[0]
+	}
+	return bundlePackage(p, pkg, prefix, symbols)
+}
+
+// bundlePackage gathers symbols plus their transitive local dependencies
+// out of pkg, renames them with prefix and appends the result to
+// p.bundled. Imports the bundled code still needs are forwarded to
+// p.NewImport so they land in the destination file's normal import block.
+func bundlePackage(p *printer, pkg *packages.Package, prefix string, symbols []string) error {
+	declByName := make(map[string]ast.Decl)
+	methodsByRecv := make(map[string][]ast.Decl)
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv != nil {
+				recv := receiverTypeName(fd)
+				methodsByRecv[recv] = append(methodsByRecv[recv], decl)
+				continue
+			}
+			for _, name := range declNames(decl) {
+				declByName[name] = decl
+			}
+		}
+	}
+
+	needed := make(map[ast.Decl]bool)
+	var include func(decl ast.Decl)
+	include = func(decl ast.Decl) {
+		if needed[decl] {
+			return
+		}
+		needed[decl] = true
+		// A bundled type's methods aren't reached via declByName.
+		for _, name := range declNames(decl) {
+			for _, method := range methodsByRecv[name] {
+				include(method)
+			}
+		}
+		ast.Inspect(decl, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			use := pkg.TypesInfo.Uses[ident]
+			if use == nil || use.Parent() != pkg.Types.Scope() {
+				// Not a package-level object; a local with the same
+				// name must not pull in an unrelated declaration.
+				return true
+			}
+			if dep, ok := declByName[use.Name()]; ok {
+				include(dep)
+			}
+			return true
+		})
+	}
+	for _, name := range symbols {
+		decl, ok := declByName[name]
+		if !ok {
+			return fmt.Errorf("bundle: %q has no top-level declaration %q", pkg.PkgPath, name)
+		}
+		include(decl)
+	}
+
+	// Keep the source order of the declarations we're bringing along.
+	var decls []ast.Decl
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if needed[decl] {
+				decls = append(decls, decl)
+			}
+		}
+	}
+
+	renameDecls(p, pkg, decls, prefix)
+
+	var buf bytes.Buffer
+	for _, decl := range decls {
+		if err := format.Node(&buf, pkg.Fset, decl); err != nil {
+			return err
+		}
+		buf.WriteString("\n\n")
+	}
+	if p.bundled == nil {
+		p.bundled = bytes.NewBuffer(nil)
+	}
+	p.bundled.Write(buf.Bytes())
+	return nil
+}
+
+// receiverTypeName returns "Helper" for both (h Helper) and (h *Helper).
+func receiverTypeName(fd *ast.FuncDecl) string {
+	expr := fd.Recv.List[0].Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// declNames returns the top-level names introduced by decl. Methods are
+// skipped; bundlePackage pulls them in separately via methodsByRecv.
+func declNames(decl ast.Decl) []string {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv != nil {
+			return nil
+		}
+		return []string{d.Name.Name}
+	case *ast.GenDecl:
+		var names []string
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				for _, n := range s.Names {
+					names = append(names, n.Name)
+				}
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// renameDecls prefixes every package-level identifier defined by decls,
+// and forwards any other package's qualifiers through p.NewImport.
+func renameDecls(p *printer, pkg *packages.Package, decls []ast.Decl, prefix string) {
+	bundled := make(map[types.Object]bool)
+	for _, decl := range decls {
+		for _, name := range declNames(decl) {
+			if obj := pkg.Types.Scope().Lookup(name); obj != nil {
+				bundled[obj] = true
+			}
+		}
+	}
+
+	for _, decl := range decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			if obj := pkg.TypesInfo.Defs[ident]; obj != nil && bundled[obj] {
+				ident.Name = prefix + ident.Name
+				return true
+			}
+			if obj := pkg.TypesInfo.Uses[ident]; obj != nil {
+				if bundled[obj] {
+					ident.Name = prefix + ident.Name
+				} else if pname, ok := obj.(*types.PkgName); ok {
+					ident.Name = p.NewImport(pname.Name(), pname.Imported().Path())()
+				}
+			}
+			return true
+		})
+	}
+}
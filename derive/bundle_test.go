@@ -0,0 +1,133 @@
+//  Copyright 2017 Walter Schulze
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package derive
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// mustCheckPackage type-checks src in place, without going through
+// packages.Load (which needs a real module to resolve), and wraps the
+// result in a *packages.Package so it can be fed straight to
+// bundlePackage/renameDecls.
+func mustCheckPackage(t *testing.T, src string) *packages.Package {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "bundle_test_src.go", src, 0)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: importer.Default()}
+	pkg, err := conf.Check(f.Name.Name, fset, []*ast.File{f}, info)
+	if err != nil {
+		t.Fatalf("typecheck: %v", err)
+	}
+	return &packages.Package{
+		PkgPath:   f.Name.Name,
+		Fset:      fset,
+		Syntax:    []*ast.File{f},
+		Types:     pkg,
+		TypesInfo: info,
+	}
+}
+
+func TestBundlePackageTransitiveDeps(t *testing.T) {
+	pkg := mustCheckPackage(t, `package helpers
+
+func Helper(x int) int {
+	return helper2(x) + 1
+}
+
+func helper2(x int) int {
+	return x * 2
+}
+
+func Unused() int {
+	return 0
+}
+`)
+	p := &printer{}
+	if err := bundlePackage(p, pkg, "h_", []string{"Helper"}); err != nil {
+		t.Fatalf("bundlePackage: %v", err)
+	}
+	out := p.bundled.String()
+	if !strings.Contains(out, "func h_Helper") {
+		t.Errorf("expected Helper renamed, got:\n%s", out)
+	}
+	if !strings.Contains(out, "func h_helper2") {
+		t.Errorf("expected transitive dependency helper2 pulled in and renamed, got:\n%s", out)
+	}
+	if strings.Contains(out, "Unused") {
+		t.Errorf("unreferenced declaration must not be bundled, got:\n%s", out)
+	}
+}
+
+func TestBundlePackageMethodPullIn(t *testing.T) {
+	pkg := mustCheckPackage(t, `package helpers
+
+type Set struct{ m map[string]bool }
+
+func (s *Set) Add(k string) { s.m[k] = true }
+
+func NewSet() *Set { return &Set{m: map[string]bool{}} }
+`)
+	p := &printer{}
+	if err := bundlePackage(p, pkg, "h_", []string{"NewSet"}); err != nil {
+		t.Fatalf("bundlePackage: %v", err)
+	}
+	out := p.bundled.String()
+	if !strings.Contains(out, "h_Set") {
+		t.Errorf("expected Set type bundled, got:\n%s", out)
+	}
+	if !strings.Contains(out, "func (s *h_Set) Add") {
+		t.Errorf("expected Add method pulled in with its receiver renamed, got:\n%s", out)
+	}
+}
+
+func TestNewBundledImportDedupsIdenticalRequest(t *testing.T) {
+	p := newPrinter("foo").(*printer)
+	p.bundledKeys = map[string]string{"h_\x00somepkg": "Foo"}
+	// bundlePackage/packages.Load are never reached here: the key above
+	// already matches, so a real load of the bogus path "somepkg" would
+	// have panicked if this test were exercising a fresh bundle.
+	imp := p.NewBundledImport("h", "somepkg", "Foo")
+	if prefix := imp(); prefix != "h_" {
+		t.Errorf("expected prefix %q, got %q", "h_", prefix)
+	}
+}
+
+func TestNewBundledImportRejectsSymbolMismatch(t *testing.T) {
+	p := newPrinter("foo").(*printer)
+	p.bundledKeys = map[string]string{"h_\x00somepkg": "Foo"}
+	imp := p.NewBundledImport("h", "somepkg", "Foo", "Bar")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic on mismatched symbol sets")
+		}
+	}()
+	imp()
+}
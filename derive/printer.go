@@ -17,10 +17,14 @@ package derive
 import (
 	"bytes"
 	"fmt"
+	"go/format"
+	"hash/fnv"
 	"io"
 	"sort"
 	"strings"
 	"unicode"
+
+	"golang.org/x/tools/imports"
 )
 
 // Printer is used to print the generated code to a file.
@@ -31,19 +35,50 @@ type Printer interface {
 	WriteTo(w io.Writer) (int64, error)
 
 	NewImport(name, path string) Import
+	// NewBundledImport copies the named top-level declarations (and
+	// anything they depend on) out of path and into the generated file
+	// under a name mangled with name, instead of importing path.
+	NewBundledImport(name, path string, symbols ...string) Import
 	HasContent() bool
+
+	// SetBuildTags attaches build constraints to the generated file.
+	SetBuildTags(tags ...string)
+	// NewFile returns a sibling Printer for the same destination package,
+	// so one plugin run can spread its output over several files. The
+	// caller writes it out under its own suffix, e.g. derived_<suffix>.go.
+	NewFile(suffix string) Printer
+}
+
+// importRequest records a single (name, path) pair registered through an
+// Import closure, in the order the closures were first invoked.
+type importRequest struct {
+	name string
+	path string
 }
 
 type printer struct {
-	pkgName    string
-	w          *bytes.Buffer
-	indent     string
-	imports    map[string]string
-	hasContent bool
+	pkgName     string
+	suffix      string
+	w           *bytes.Buffer
+	bundled     *bytes.Buffer
+	bundledKeys map[string]string
+	indent      string
+	imports     []importRequest
+	hasContent  bool
+	format      bool
+	buildTags   []string
 }
 
 func newPrinter(pkgName string) Printer {
-	return &printer{pkgName, bytes.NewBuffer(nil), "", make(map[string]string), false}
+	return &printer{pkgName: pkgName, w: bytes.NewBuffer(nil)}
+}
+
+// NewFormattedPrinter is like newPrinter, but runs the output through
+// go/format.Source before writing it out.
+func NewFormattedPrinter(pkgName string) Printer {
+	p := newPrinter(pkgName).(*printer)
+	p.format = true
+	return p
 }
 
 func badToUnderscore(r rune) rune {
@@ -67,10 +102,6 @@ func unvendor(path string) string {
 	return path
 }
 
-func makeFullpath(path string) string {
-	return strings.Map(badToUnderscore, path)
-}
-
 func makeAlias(path string) string {
 	// create import alias
 	fullpath := strings.Map(badToUnderscore, path)
@@ -78,27 +109,91 @@ func makeAlias(path string) string {
 	return fullpaths[len(fullpaths)-1]
 }
 
+// importPlaceholder stands in for an import's alias until render() can
+// resolve it; it uses runes that cannot occur in real Go source.
+func importPlaceholder(id int) string {
+	return fmt.Sprintf("⁣goderive_import%d⁣", id)
+}
+
 func (p *printer) NewImport(name, path string) Import {
+	path = unvendor(path)
+	registered := false
+	var placeholder string
 	return func() string {
-		path = unvendor(path)
-		fullpath := makeFullpath(path)
-		alias := name
-
-		if _, ok := p.imports[alias]; !ok {
-			p.imports[alias] = path
-			return alias
+		if !registered {
+			registered = true
+			id := len(p.imports)
+			p.imports = append(p.imports, importRequest{name: name, path: path})
+			placeholder = importPlaceholder(id)
 		}
-		if p.imports[alias] == path {
-			return alias
+		return placeholder
+	}
+}
+
+// resolvedImport is one entry in the generated import block, after alias
+// collisions have been resolved.
+type resolvedImport struct {
+	path  string
+	alias string
+}
+
+// resolveImports assigns the final alias for every registered import path,
+// independent of the order their Import closures fired in: paths and, for
+// a given path, requested names are sorted, so the lexicographically-first
+// claimant of a name keeps it and later claimants are demoted to
+// "<lastPathSegment>_<hash>". If a demoted alias is already claimed by
+// another path (e.g. one that requested that very name), it panics rather
+// than swap one.
+func (p *printer) resolveImports() ([]resolvedImport, map[int]string) {
+	type group struct {
+		path      string
+		requested []string
+		ids       []int
+	}
+	groups := make(map[string]*group)
+	var paths []string
+	for id, req := range p.imports {
+		g, ok := groups[req.path]
+		if !ok {
+			g = &group{path: req.path}
+			groups[req.path] = g
+			paths = append(paths, req.path)
 		}
-		if path2, ok := p.imports[fullpath]; ok {
-			if path2 != path {
-				panic("non unique fullpath: " + path2 + " != " + path)
+		g.requested = append(g.requested, req.name)
+		g.ids = append(g.ids, id)
+	}
+	sort.Strings(paths)
+	for _, g := range groups {
+		sort.Strings(g.requested)
+	}
+
+	claimedBy := make(map[string]string)
+	substitutions := make(map[int]string)
+	imports := make([]resolvedImport, 0, len(paths))
+	for _, path := range paths {
+		g := groups[path]
+		alias := g.requested[0]
+		if owner, ok := claimedBy[alias]; ok && owner != path {
+			alias = demote(path)
+			if owner, ok := claimedBy[alias]; ok && owner != path {
+				panic(fmt.Sprintf("goderive: import alias conflict: %q and %q both resolve to %q", owner, path, alias))
 			}
 		}
-		p.imports[fullpath] = path
-		return fullpath
+		claimedBy[alias] = path
+		imports = append(imports, resolvedImport{path: path, alias: alias})
+		for _, id := range g.ids {
+			substitutions[id] = alias
+		}
 	}
+	return imports, substitutions
+}
+
+// demote computes the fallback alias for a path that lost its requested
+// name to a lexicographically earlier path.
+func demote(path string) string {
+	sum := fnv.New32a()
+	sum.Write([]byte(path))
+	return fmt.Sprintf("%s_%x", makeAlias(path), sum.Sum32())
 }
 
 func (p *printer) P(format string, a ...interface{}) {
@@ -114,44 +209,100 @@ func (p *printer) Out() {
 	if len(p.indent) > 0 {
 		p.indent = p.indent[1:]
 	} else {
-		panic("bug in code generator: unindenting more than has been indented")
+		panic("bug in code generator: unindenting more than has been indented" + p.fileDesc())
 	}
 }
 
+// fileDesc names the file a diagnostic belongs to, e.g. " (file: windows)".
+func (p *printer) fileDesc() string {
+	if p.suffix == "" {
+		return ""
+	}
+	return " (file: " + p.suffix + ")"
+}
+
 func (p *printer) HasContent() bool {
-	return p.hasContent
+	return p.hasContent || p.bundled != nil
 }
 
-func (p *printer) WriteTo(file io.Writer) (int64, error) {
-	top := bytes.NewBuffer(nil)
+func (p *printer) SetBuildTags(tags ...string) {
+	p.buildTags = tags
+}
+
+func (p *printer) NewFile(suffix string) Printer {
+	np := newPrinter(p.pkgName).(*printer)
+	np.format = p.format
+	np.suffix = suffix
+	return np
+}
+
+// render assembles the header, import block, bundled declarations and body
+// into a single buffer, in the order they are written out by WriteTo.
+func (p *printer) render() *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
 	// conform to golang standard https://golang.org/s/generatedcode
-	top.WriteString("// Code generated by goderive DO NOT EDIT.\n")
-	top.WriteString("\n")
-	top.WriteString("package " + p.pkgName + "\n")
-	if len(p.imports) > 0 {
-		top.WriteString("\n")
-		top.WriteString("import (\n")
-		paths := make([]string, 0, len(p.imports))
-		pathToQual := make(map[string]string, len(p.imports))
-		for qual, path := range p.imports {
-			pathToQual[path] = qual
-			paths = append(paths, path)
-		}
-		sort.Strings(paths)
-		for _, path := range paths {
-			qual := pathToQual[path]
-			if qual == path {
-				top.WriteString("\t\"" + path + "\"\n")
+	buf.WriteString("// Code generated by goderive DO NOT EDIT.\n")
+	buf.WriteString("\n")
+	if len(p.buildTags) > 0 {
+		buf.WriteString("//go:build " + strings.Join(p.buildTags, " || ") + "\n")
+		buf.WriteString("// +build " + strings.Join(p.buildTags, " ") + "\n")
+		buf.WriteString("\n")
+	}
+	buf.WriteString("package " + p.pkgName + "\n")
+
+	resolved, substitutions := p.resolveImports()
+	if len(resolved) > 0 {
+		buf.WriteString("\n")
+		buf.WriteString("import (\n")
+		for _, imp := range resolved {
+			if imp.alias == makeAlias(imp.path) {
+				buf.WriteString("\t\"" + imp.path + "\"\n")
 			} else {
-				top.WriteString("\t" + qual + " \"" + path + "\"\n")
+				buf.WriteString("\t" + imp.alias + " \"" + imp.path + "\"\n")
 			}
 		}
-		top.WriteString(")\n")
+		buf.WriteString(")\n")
 	}
-	n1, err := top.WriteTo(file)
+
+	body := bytes.NewBuffer(nil)
+	if p.bundled != nil {
+		body.WriteString("\n")
+		body.Write(p.bundled.Bytes())
+	}
+	body.Write(p.w.Bytes())
+
+	replacements := make([]string, 0, 2*len(substitutions))
+	for id, alias := range substitutions {
+		replacements = append(replacements, importPlaceholder(id), alias)
+	}
+	strings.NewReplacer(replacements...).WriteString(buf, body.String())
+	return buf
+}
+
+func (p *printer) WriteTo(file io.Writer) (int64, error) {
+	buf := p.render()
+	if !p.format {
+		return buf.WriteTo(file)
+	}
+	src, err := format.Source(buf.Bytes())
 	if err != nil {
-		return n1, err
+		return 0, fmt.Errorf("goderive: generated code does not compile%s: %v\n%s", p.fileDesc(), err, numberLines(buf.Bytes()))
+	}
+	// Drop any imports left dangling by an Import closure that was called
+	// but whose alias never ended up in the generated code.
+	if cleaned, err := imports.Process("", src, nil); err == nil {
+		src = cleaned
+	}
+	n, err := file.Write(src)
+	return int64(n), err
+}
+
+// numberLines prefixes every line of src with its 1-based line number.
+func numberLines(src []byte) string {
+	lines := strings.Split(string(src), "\n")
+	buf := bytes.NewBuffer(nil)
+	for i, line := range lines {
+		fmt.Fprintf(buf, "%4d| %s\n", i+1, line)
 	}
-	n2, err := p.w.WriteTo(file)
-	return n1 + n2, err
+	return buf.String()
 }
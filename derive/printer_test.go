@@ -0,0 +1,111 @@
+//  Copyright 2017 Walter Schulze
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package derive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewFileAndBuildTags(t *testing.T) {
+	main := NewFormattedPrinter("foo")
+	main.P("var X = 1")
+
+	extra := main.NewFile("windows")
+	extra.SetBuildTags("windows")
+	extra.P("var Y = 2")
+
+	var buf strings.Builder
+	if _, err := extra.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "//go:build windows") {
+		t.Errorf("expected go:build constraint, got:\n%s", out)
+	}
+	if !strings.Contains(out, "// +build windows") {
+		t.Errorf("expected +build constraint, got:\n%s", out)
+	}
+	if !strings.Contains(out, "package foo") {
+		t.Errorf("expected package foo, got:\n%s", out)
+	}
+	if strings.Contains(out, "X = 1") {
+		t.Errorf("sibling file must not contain the main file's content:\n%s", out)
+	}
+}
+
+func TestNewFileSuffixInDiagnostics(t *testing.T) {
+	main := newPrinter("foo")
+	extra := main.NewFile("windows")
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("expected a panic")
+		}
+		if !strings.Contains(r.(string), "windows") {
+			t.Errorf("expected panic to name the file suffix, got: %v", r)
+		}
+	}()
+	extra.Out()
+}
+
+func TestResolveImportsDeterministicAcrossPaths(t *testing.T) {
+	p := &printer{imports: []importRequest{
+		{name: "bytes", path: "b/bytes"},
+		{name: "bytes", path: "a/bytes"},
+	}}
+	resolved, _ := p.resolveImports()
+	byPath := make(map[string]string, len(resolved))
+	for _, r := range resolved {
+		byPath[r.path] = r.alias
+	}
+	if byPath["a/bytes"] != "bytes" {
+		t.Errorf("lexicographically-first path should keep the requested alias, got %q", byPath["a/bytes"])
+	}
+	if want := demote("b/bytes"); byPath["b/bytes"] != want {
+		t.Errorf("second path should be demoted to %q, got %q", want, byPath["b/bytes"])
+	}
+}
+
+func TestResolveImportsSamePathTieBreakIsOrderIndependent(t *testing.T) {
+	byFirstCall := (&printer{imports: []importRequest{
+		{name: "zeta", path: "x/y"},
+		{name: "alpha", path: "x/y"},
+	}})
+	byReverseCall := (&printer{imports: []importRequest{
+		{name: "alpha", path: "x/y"},
+		{name: "zeta", path: "x/y"},
+	}})
+	r1, _ := byFirstCall.resolveImports()
+	r2, _ := byReverseCall.resolveImports()
+	if r1[0].alias != "alpha" || r2[0].alias != "alpha" {
+		t.Errorf("expected alias %q regardless of call order, got %q and %q", "alpha", r1[0].alias, r2[0].alias)
+	}
+}
+
+func TestResolveImportsPanicsOnUnresolvableConflict(t *testing.T) {
+	p := &printer{imports: []importRequest{
+		{name: "pkg", path: "github.com/a"},
+		{name: "pkg", path: "zzz/pkg"},
+		{name: demote("zzz/pkg"), path: "aaa/extra"},
+	}}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic on an unresolvable alias conflict")
+		}
+	}()
+	p.resolveImports()
+}